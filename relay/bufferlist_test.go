@@ -0,0 +1,78 @@
+package relay
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// TestBufferListPerKeyOrdering checks the core guarantee bufferList.pop makes
+// for concurrent delivery: batches for the same key always pop out in the
+// order they were queued, even with two workers draining the list at once.
+func TestBufferListPerKeyOrdering(t *testing.T) {
+	l := newBufferList(1<<20, 1<<20, 0)
+
+	const perKey = 20
+	for i := 0; i < perKey; i++ {
+		if _, err := l.add([]byte(fmt.Sprintf("a%d", i)), "/query", "q=a", "", nil); err != nil {
+			t.Fatalf("add a: %v", err)
+		}
+		if _, err := l.add([]byte(fmt.Sprintf("b%d", i)), "/query", "q=b", "", nil); err != nil {
+			t.Fatalf("add b: %v", err)
+		}
+	}
+
+	var mu sync.Mutex
+	var gotA, gotB []string
+	remaining := int32(2 * perKey)
+
+	// Two workers drain the list concurrently, the way retryBuffer.worker
+	// does: pop a batch, "deliver" it, release the key. remaining bounds
+	// exactly how many pop() calls are made in total, so a worker never
+	// blocks in pop() after the other has drained the list.
+	worker := func(wg *sync.WaitGroup) {
+		defer wg.Done()
+		for {
+			if atomic.AddInt32(&remaining, -1) < 0 {
+				return
+			}
+
+			popped := l.pop()
+			payload := string(popped.batch.bufs[0])
+
+			mu.Lock()
+			switch popped.key.query {
+			case "q=a":
+				gotA = append(gotA, payload)
+			case "q=b":
+				gotB = append(gotB, payload)
+			default:
+				t.Errorf("unexpected key %q", popped.key.query)
+			}
+			mu.Unlock()
+
+			l.release(popped.key)
+		}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go worker(&wg)
+	go worker(&wg)
+	wg.Wait()
+
+	if len(gotA) != perKey || len(gotB) != perKey {
+		t.Fatalf("got %d a-batches and %d b-batches, want %d each", len(gotA), len(gotB), perKey)
+	}
+	for i, payload := range gotA {
+		if want := fmt.Sprintf("a%d", i); payload != want {
+			t.Errorf("key a popped %v, want strictly enqueue order: position %d = %q, want %q", gotA, i, payload, want)
+		}
+	}
+	for i, payload := range gotB {
+		if want := fmt.Sprintf("b%d", i); payload != want {
+			t.Errorf("key b popped %v, want strictly enqueue order: position %d = %q, want %q", gotB, i, payload, want)
+		}
+	}
+}
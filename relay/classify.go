@@ -0,0 +1,62 @@
+package relay
+
+import (
+	"fmt"
+)
+
+// retryDecision is the outcome of classifying a post attempt: whether it
+// succeeded, and if not, whether it is worth retrying at all.
+type retryDecision struct {
+	success bool
+	retry   bool
+	reason  string
+}
+
+// classify replaces the old "resp.StatusCode/100 != 5" check with a real
+// distinction between the kinds of failure a post() can return:
+//
+//   - transport errors (err != nil)            -> retry
+//   - 5xx                                      -> retry
+//   - 429                                      -> retry
+//     (the poster interface in this tree does not surface response headers,
+//     so Retry-After cannot be read here; 429 falls back to the normal
+//     exponential backoff used for 5xx)
+//   - 400 / 413 (partial-write / request too large) -> not retriable, the
+//     request itself is bad and resending it will never succeed
+//   - 401 / 403                                -> not retriable, fail fast
+//     so a bad credential does not buffer forever
+//   - anything else                            -> retry, conservatively
+func classify(resp *responseData, err error) retryDecision {
+	if err != nil {
+		return retryDecision{retry: true, reason: fmt.Sprintf("transport error: %v", err)}
+	}
+
+	switch {
+	case resp.StatusCode/100 == 2:
+		return retryDecision{success: true}
+
+	case resp.StatusCode == 429:
+		return retryDecision{retry: true, reason: "429 too many requests"}
+
+	case resp.StatusCode/100 == 5:
+		return retryDecision{retry: true, reason: fmt.Sprintf("%d server error", resp.StatusCode)}
+
+	case resp.StatusCode == 400 || resp.StatusCode == 413:
+		return retryDecision{retry: false, reason: fmt.Sprintf("%d rejected: %s", resp.StatusCode, truncateBody(resp.Body))}
+
+	case resp.StatusCode == 401 || resp.StatusCode == 403:
+		return retryDecision{retry: false, reason: fmt.Sprintf("%d auth error", resp.StatusCode)}
+
+	default:
+		return retryDecision{retry: true, reason: fmt.Sprintf("%d unexpected status", resp.StatusCode)}
+	}
+}
+
+const maxReasonBodyLen = 256
+
+func truncateBody(body []byte) string {
+	if len(body) > maxReasonBodyLen {
+		return string(body[:maxReasonBodyLen]) + "..."
+	}
+	return string(body)
+}
@@ -0,0 +1,43 @@
+package relay
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name        string
+		resp        *responseData
+		err         error
+		wantSuccess bool
+		wantRetry   bool
+	}{
+		{"transport error", nil, errors.New("connection refused"), false, true},
+		{"200 OK", &responseData{StatusCode: 200}, nil, true, false},
+		{"204 No Content", &responseData{StatusCode: 204}, nil, true, false},
+		{"429 too many requests", &responseData{StatusCode: 429}, nil, false, true},
+		{"500 server error", &responseData{StatusCode: 500}, nil, false, true},
+		{"503 unavailable", &responseData{StatusCode: 503}, nil, false, true},
+		{"400 bad request", &responseData{StatusCode: 400, Body: []byte("bad line")}, nil, false, false},
+		{"413 too large", &responseData{StatusCode: 413}, nil, false, false},
+		{"401 unauthorized", &responseData{StatusCode: 401}, nil, false, false},
+		{"403 forbidden", &responseData{StatusCode: 403}, nil, false, false},
+		{"404 unexpected", &responseData{StatusCode: 404}, nil, false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := classify(tt.resp, tt.err)
+			if got.success != tt.wantSuccess {
+				t.Errorf("success = %v, want %v", got.success, tt.wantSuccess)
+			}
+			if got.retry != tt.wantRetry {
+				t.Errorf("retry = %v, want %v", got.retry, tt.wantRetry)
+			}
+			if !got.success && got.reason == "" {
+				t.Error("non-success decision should carry a reason")
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package relay
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+)
+
+// DeadLetterSink receives batches that will never be delivered: either the
+// upstream rejected them with a non-retriable status, or they exhausted
+// maxAttempts while retriable. Implementations must not block the caller
+// for long, since they run inline on a retryBuffer worker.
+type DeadLetterSink interface {
+	Write(batch *batch, statusCode int, reason string) error
+}
+
+// fileDeadLetterSink writes each dead-lettered batch as a pair of files
+// under dir: "<id>.line" holding the raw line-protocol bytes that were
+// rejected, and "<id>.meta" holding the path/query/auth/status/reason that
+// caused it to be dropped.
+type fileDeadLetterSink struct {
+	dir string
+	seq int64
+}
+
+func newFileDeadLetterSink(dir string) (*fileDeadLetterSink, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &fileDeadLetterSink{dir: dir}, nil
+}
+
+func (s *fileDeadLetterSink) Write(b *batch, statusCode int, reason string) error {
+	id := atomic.AddInt64(&s.seq, 1)
+	base := fmt.Sprintf("%020d", id)
+
+	linePath := filepath.Join(s.dir, base+".line")
+	f, err := os.Create(linePath)
+	if err != nil {
+		return err
+	}
+	for _, buf := range b.bufs {
+		if _, err := f.Write(buf); err != nil {
+			f.Close()
+			return err
+		}
+		if b.path == "/write" {
+			// bufs holds individual points with their trailing newline
+			// already stripped by splitLines; restore it so the .line
+			// file is valid, replayable line protocol rather than
+			// points glued together. Mirrors worker()'s POST-body
+			// reconstruction.
+			if _, err := f.Write([]byte("\n")); err != nil {
+				f.Close()
+				return err
+			}
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	meta := fmt.Sprintf(
+		"path=%s\nquery=%s\nauth=%s\nstatus=%d\nreason=%s\nattempts=%d\n",
+		b.path, b.query, b.auth, statusCode, reason, b.attempts,
+	)
+	return os.WriteFile(filepath.Join(s.dir, base+".meta"), []byte(meta), 0o644)
+}
@@ -0,0 +1,46 @@
+package relay
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestFileDeadLetterSinkWriteLineProtocol guards against the regression
+// where a dead-lettered /write batch's points, stored in bufs with their
+// trailing newline already stripped by splitLines, were written back-to-back
+// with no separator -- producing a .line file that is not valid, replayable
+// line protocol.
+func TestFileDeadLetterSinkWriteLineProtocol(t *testing.T) {
+	dir := t.TempDir()
+	s, err := newFileDeadLetterSink(dir)
+	if err != nil {
+		t.Fatalf("newFileDeadLetterSink: %v", err)
+	}
+
+	b := &batch{
+		path: "/write",
+		bufs: [][]byte{
+			[]byte("cpu,host=a value=1 100"),
+			[]byte("cpu,host=b value=2 200"),
+		},
+	}
+	if err := s.Write(b, 400, "bad request"); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "00000000000000000001.line"))
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+
+	want := "cpu,host=a value=1 100\ncpu,host=b value=2 200\n"
+	if string(data) != want {
+		t.Errorf(".line file = %q, want %q", data, want)
+	}
+
+	points := splitLines(data)
+	if len(points) != 2 {
+		t.Errorf("splitLines on dead-lettered body returned %d points, want 2", len(points))
+	}
+}
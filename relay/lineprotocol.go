@@ -0,0 +1,172 @@
+package relay
+
+import (
+	"net/url"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// splitLines breaks a line-protocol write body into its individual points,
+// splitting on '\n' but treating bytes inside an (unescaped) double-quoted
+// string field as literal, since a quoted string field may itself contain a
+// raw newline. Empty lines are dropped. A trailing '\r' on each line (as
+// sent by some clients) is trimmed.
+func splitLines(buf []byte) [][]byte {
+	var lines [][]byte
+
+	start := 0
+	inQuotes := false
+	escaped := false
+
+	emit := func(end int) {
+		line := buf[start:end]
+		if len(line) > 0 && line[len(line)-1] == '\r' {
+			line = line[:len(line)-1]
+		}
+		if len(line) > 0 {
+			lines = append(lines, line)
+		}
+	}
+
+	for i := 0; i < len(buf); i++ {
+		c := buf[i]
+		if escaped {
+			escaped = false
+			continue
+		}
+		switch c {
+		case '\\':
+			escaped = true
+		case '"':
+			inQuotes = !inQuotes
+		case '\n':
+			if !inQuotes {
+				emit(i)
+				start = i + 1
+			}
+		}
+	}
+	if start < len(buf) {
+		emit(len(buf))
+	}
+
+	return lines
+}
+
+// lastUnquotedSpace returns the index of the last space in line that is not
+// inside a quoted string field, or -1 if there is none. Line protocol points
+// are "measurement,tags fields [timestamp]"; the last unquoted space, if
+// any, separates the fields from the optional timestamp.
+func lastUnquotedSpace(line []byte) int {
+	inQuotes := false
+	escaped := false
+	last := -1
+
+	for i, c := range line {
+		if escaped {
+			escaped = false
+			continue
+		}
+		switch c {
+		case '\\':
+			escaped = true
+		case '"':
+			inQuotes = !inQuotes
+		case ' ':
+			if !inQuotes {
+				last = i
+			}
+		}
+	}
+	return last
+}
+
+// precisionMultiplier returns the factor to convert a timestamp in the given
+// query-string precision into nanoseconds. An empty precision means ns, the
+// InfluxDB write API default.
+func precisionMultiplier(precision string) (int64, bool) {
+	switch precision {
+	case "", "ns":
+		return 1, true
+	case "u", "us":
+		return int64(time.Microsecond), true
+	case "ms":
+		return int64(time.Millisecond), true
+	case "s":
+		return int64(time.Second), true
+	case "m":
+		return int64(time.Minute), true
+	case "h":
+		return int64(time.Hour), true
+	default:
+		return 0, false
+	}
+}
+
+// normalizeLinePrecision rewrites a point's trailing timestamp, if any, from
+// the given precision into nanoseconds, so that points arriving with
+// different precision= query parameters can still be coalesced into the
+// same outgoing batch. Points with no timestamp (server-assigned time) or
+// an unrecognized precision are returned unchanged.
+func normalizeLinePrecision(line []byte, precision string) []byte {
+	mult, ok := precisionMultiplier(precision)
+	if !ok || mult == 1 {
+		return line
+	}
+
+	idx := lastUnquotedSpace(line)
+	if idx < 0 {
+		return line
+	}
+
+	ts, err := strconv.ParseInt(string(line[idx+1:]), 10, 64)
+	if err != nil {
+		// last token isn't a timestamp after all (e.g. it's the fields
+		// section and the point has no timestamp); leave as-is.
+		return line
+	}
+
+	out := make([]byte, 0, idx+1+20)
+	out = append(out, line[:idx+1]...)
+	out = strconv.AppendInt(out, ts*mult, 10)
+	return out
+}
+
+// writeKey splits a /write query string into the part that identifies the
+// destination (db, rp, ...) and the precision, so that writes differing
+// only in precision are still coalesced into one outgoing batch once their
+// timestamps have been normalized to nanoseconds.
+func writeKey(rawQuery string) (destQuery string, precision string) {
+	v, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return rawQuery, ""
+	}
+	precision = v.Get("precision")
+	v.Del("precision")
+	return v.Encode(), precision
+}
+
+var (
+	partialWriteRE     = regexp.MustCompile(`partial write`)
+	partialWriteLineRE = regexp.MustCompile(`unable to parse '(.*?)':`)
+)
+
+// isPartialWrite reports whether body looks like InfluxDB's "partial write"
+// error, returned with HTTP 400 when some but not all points in a write
+// were rejected.
+func isPartialWrite(body []byte) bool {
+	return partialWriteRE.Match(body)
+}
+
+// partialWriteBadLines extracts the offending point(s) quoted in a partial
+// write error message, e.g. "partial write: unable to parse 'bad line':
+// invalid field format dropped=1".
+func partialWriteBadLines(body []byte) [][]byte {
+	matches := partialWriteLineRE.FindAllSubmatch(body, -1)
+	bad := make([][]byte, 0, len(matches))
+	for _, m := range matches {
+		bad = append(bad, m[1])
+	}
+	return bad
+}
@@ -0,0 +1,128 @@
+package relay
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSplitLines(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want []string
+	}{
+		{
+			name: "simple points",
+			in:   "m1,t=1 f=1 100\nm2,t=2 f=2 200\n",
+			want: []string{"m1,t=1 f=1 100", "m2,t=2 f=2 200"},
+		},
+		{
+			name: "trailing CRLF",
+			in:   "m1,t=1 f=1 100\r\nm2,t=2 f=2 200\r\n",
+			want: []string{"m1,t=1 f=1 100", "m2,t=2 f=2 200"},
+		},
+		{
+			name: "blank lines dropped",
+			in:   "m1,t=1 f=1 100\n\nm2,t=2 f=2 200\n",
+			want: []string{"m1,t=1 f=1 100", "m2,t=2 f=2 200"},
+		},
+		{
+			name: "quoted newline preserved as one line",
+			in:   "m1,t=1 f=\"a\nb\" 100\nm2,t=2 f=2 200\n",
+			want: []string{"m1,t=1 f=\"a\nb\" 100", "m2,t=2 f=2 200"},
+		},
+		{
+			name: "no trailing newline",
+			in:   "m1,t=1 f=1 100",
+			want: []string{"m1,t=1 f=1 100"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := splitLines([]byte(tt.in))
+			if len(got) != len(tt.want) {
+				t.Fatalf("splitLines(%q) = %d lines, want %d: %q", tt.in, len(got), len(tt.want), got)
+			}
+			for i, line := range got {
+				if string(line) != tt.want[i] {
+					t.Errorf("line %d = %q, want %q", i, line, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestNormalizeLinePrecision(t *testing.T) {
+	tests := []struct {
+		precision string
+		in        string
+		want      string
+	}{
+		{"", "m,t=1 f=1 100", "m,t=1 f=1 100"},
+		{"ns", "m,t=1 f=1 100", "m,t=1 f=1 100"},
+		{"us", "m,t=1 f=1 100", "m,t=1 f=1 100000"},
+		{"ms", "m,t=1 f=1 100", "m,t=1 f=1 100000000"},
+		{"s", "m,t=1 f=1 100", "m,t=1 f=1 100000000000"},
+		{"ms", "m,t=1 f=1", "m,t=1 f=1"},            // no timestamp, left alone
+		{"bogus", "m,t=1 f=1 100", "m,t=1 f=1 100"}, // unrecognized, left alone
+	}
+
+	for _, tt := range tests {
+		got := normalizeLinePrecision([]byte(tt.in), tt.precision)
+		if string(got) != tt.want {
+			t.Errorf("normalizeLinePrecision(%q, %q) = %q, want %q", tt.in, tt.precision, got, tt.want)
+		}
+	}
+}
+
+// TestSplitAndNormalizeRoundTrip checks that splitting a multi-point write
+// body and normalizing each point's precision, then rejoining them with '\n'
+// the way worker() does, produces a body splitLines parses back into the
+// same number of points with the expected normalized timestamps.
+func TestSplitAndNormalizeRoundTrip(t *testing.T) {
+	body := []byte("m1,t=1 f=1 1\nm2,t=2 f=2 2\nm3,t=3 f=3 3\n")
+
+	points := splitLines(body)
+	if len(points) != 3 {
+		t.Fatalf("splitLines returned %d points, want 3", len(points))
+	}
+
+	var rejoined bytes.Buffer
+	for _, p := range points {
+		rejoined.Write(normalizeLinePrecision(p, "ms"))
+		rejoined.WriteByte('\n')
+	}
+
+	got := splitLines(rejoined.Bytes())
+	want := []string{"m1,t=1 f=1 1000000", "m2,t=2 f=2 2000000", "m3,t=3 f=3 3000000"}
+	if len(got) != len(want) {
+		t.Fatalf("rejoined body has %d points, want %d: %q", len(got), len(want), rejoined.String())
+	}
+	for i, line := range got {
+		if string(line) != want[i] {
+			t.Errorf("point %d = %q, want %q", i, line, want[i])
+		}
+	}
+}
+
+func TestWriteKey(t *testing.T) {
+	destQuery, precision := writeKey("db=mydb&precision=ms")
+	if precision != "ms" {
+		t.Errorf("precision = %q, want ms", precision)
+	}
+	if destQuery != "db=mydb" {
+		t.Errorf("destQuery = %q, want db=mydb", destQuery)
+	}
+}
+
+func TestPartialWriteBadLines(t *testing.T) {
+	body := []byte(`partial write: unable to parse 'bad,line f="x': invalid field format dropped=1`)
+	if !isPartialWrite(body) {
+		t.Fatal("isPartialWrite = false, want true")
+	}
+	bad := partialWriteBadLines(body)
+	if len(bad) != 1 || string(bad[0]) != `bad,line f="x` {
+		t.Errorf("partialWriteBadLines = %q, want [\"bad,line f=\\\"x\"]", bad)
+	}
+}
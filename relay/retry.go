@@ -14,12 +14,40 @@ const (
 
 type Operation func() error
 
+// bufferKey identifies a distinct retry destination. Batches sharing a key
+// are delivered strictly in the order they were enqueued; batches with
+// different keys may be in flight concurrently.
+type bufferKey struct {
+	path  string
+	query string
+	auth  string
+}
+
+// writeBufferKey is the bufferKey a write to (path, query, auth) is queued
+// and retried under. For /write it strips the precision= parameter, since
+// points are normalized to nanoseconds before batching: two writes to the
+// same db/rp that only differ in precision belong to the same destination
+// and must retry in the same order.
+func writeBufferKey(path, query, auth string) bufferKey {
+	if path != "/write" {
+		return bufferKey{path, query, auth}
+	}
+	destQuery, _ := writeKey(query)
+	return bufferKey{path, destQuery, auth}
+}
+
 // Buffers and retries operations, if the buffer is full operations are dropped.
-// Only tries one operation at a time, the next operation is not attempted
-// until success or timeout of the previous operation.
-// There is no delay between attempts of different operations.
+// Up to maxConcurrent batches may be in flight at once, but batches sharing a
+// (path, query, auth) key are still delivered one at a time and in enqueue
+// order, so a single slow or down destination cannot stall unrelated writes.
 type retryBuffer struct {
-	buffering int32
+	// keyBuffering holds a *int32 per bufferKey: 0 means post() should still
+	// try a direct, unbuffered post to that destination; 1 means a previous
+	// attempt failed and writes to that key should go straight to the buffer
+	// until a retry succeeds.
+	keyBuffering sync.Map
+
+	maxConcurrent int
 
 	initialInterval time.Duration
 	multiplier      time.Duration
@@ -27,71 +55,268 @@ type retryBuffer struct {
 
 	maxBuffered int
 	maxBatch    int
+	maxPoints   int
+
+	// maxAttempts bounds how many times a worker posts a retriable batch
+	// before it is given up on and dead-lettered instead of buffered forever.
+	// Zero means unlimited.
+	maxAttempts int
+
+	// deadLetter receives batches that classify() ruled non-retriable, or
+	// that exhausted maxAttempts. Nil means such batches are simply
+	// dropped (after being counted in the stats below).
+	deadLetter DeadLetterSink
+
+	// droppedRecords counts individual dropped records (line-protocol points
+	// for /write, whole request bodies for any other path), not batches: a
+	// whole batch dropped as exhausted/non-retriable counts for batch.count
+	// records, the same unit trimPartialWrite uses when it drops one
+	// rejected point at a time.
+	droppedRecords       int64
+	deadLetteredBytes    int64
+	lastDeadLetterReason atomic.Value // string
 
 	list *bufferList
 
+	// spool durably persists buffered writes to disk so they survive a
+	// relay restart or crash. It is nil when the relay was constructed
+	// with newRetryBuffer rather than newRetryBufferWithSpool.
+	spool *spool
+
 	p poster
 }
 
-func newRetryBuffer(size, batch int, max time.Duration, p poster) *retryBuffer {
+func newRetryBuffer(size, batch, maxPoints, maxConcurrent, maxAttempts int, max time.Duration, deadLetterDir string, p poster) (*retryBuffer, error) {
+	dl, err := newDeadLetterSink(deadLetterDir)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &retryBuffer{
+		maxConcurrent:   maxConcurrent,
+		maxAttempts:     maxAttempts,
+		deadLetter:      dl,
+		initialInterval: retryInitial,
+		multiplier:      retryMultiplier,
+		maxInterval:     max,
+		maxBuffered:     size,
+		maxBatch:        batch,
+		maxPoints:       maxPoints,
+		list:            newBufferList(size, batch, maxPoints),
+		p:               p,
+	}
+	r.start()
+	return r, nil
+}
+
+// newRetryBufferWithSpool is like newRetryBuffer but additionally spools
+// every buffered write to an append-only WAL under spoolDir, so writes that
+// are still buffered when the relay restarts or crashes are not lost. On
+// return, any records found in spoolDir from a previous run have already
+// been replayed into the in-memory buffer.
+func newRetryBufferWithSpool(size, batch, maxPoints, maxConcurrent, maxAttempts int, max time.Duration, spoolDir string, maxSpoolBytes, spoolSegmentBytes int64, deadLetterDir string, p poster) (*retryBuffer, error) {
+	sp, err := newSpool(spoolDir, maxSpoolBytes, spoolSegmentBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	dl, err := newDeadLetterSink(deadLetterDir)
+	if err != nil {
+		return nil, err
+	}
+
 	r := &retryBuffer{
+		maxConcurrent:   maxConcurrent,
+		maxAttempts:     maxAttempts,
+		deadLetter:      dl,
 		initialInterval: retryInitial,
 		multiplier:      retryMultiplier,
 		maxInterval:     max,
 		maxBuffered:     size,
 		maxBatch:        batch,
-		list:            newBufferList(size, batch),
+		maxPoints:       maxPoints,
+		list:            newBufferList(size, batch, maxPoints),
+		spool:           sp,
 		p:               p,
 	}
-	go r.run()
-	return r
+
+	records, refs, err := sp.replay()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) > 0 {
+		r.list.addSpooled(records, refs)
+		for _, rec := range records {
+			atomic.StoreInt32(r.bufferingFlag(writeBufferKey(rec.path, rec.query, rec.auth)), 1)
+		}
+	}
+
+	r.start()
+	return r, nil
+}
+
+// newDeadLetterSink returns nil, nil when dir is empty: dead-lettering is
+// then a no-op other than the stats it still records.
+func newDeadLetterSink(dir string) (DeadLetterSink, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	return newFileDeadLetterSink(dir)
+}
+
+// start launches the worker pool that drains the buffer.
+func (r *retryBuffer) start() {
+	n := r.maxConcurrent
+	if n < 1 {
+		n = 1
+	}
+	for i := 0; i < n; i++ {
+		go r.worker()
+	}
+}
+
+func (r *retryBuffer) bufferingFlag(key bufferKey) *int32 {
+	v, _ := r.keyBuffering.LoadOrStore(key, new(int32))
+	return v.(*int32)
 }
 
 func (r *retryBuffer) post(buf []byte, path string, query string, auth string) (*responseData, error) {
-	if atomic.LoadInt32(&r.buffering) == 0 {
+	key := writeBufferKey(path, query, auth)
+	bufferingPtr := r.bufferingFlag(key)
+
+	if atomic.LoadInt32(bufferingPtr) == 0 {
 		resp, err := r.p.post(buf, path, query, auth)
-		// TODO A 5xx caused by the point data could cause the relay to buffer forever
-		if err == nil && resp.StatusCode/100 != 5 {
+		if classify(resp, err).success {
 			return resp, err
 		}
 		// log.Printf("Detect influxdb down")
-		atomic.StoreInt32(&r.buffering, 1)
+		atomic.StoreInt32(bufferingPtr, 1)
 	}
 
-	// already buffering or failed request
-	batch, err := r.list.add(buf, path, query, auth)
+	var ref *spoolRef
+	if r.spool != nil {
+		seg, err := r.spool.append(path, query, auth, buf)
+		if err != nil {
+			return nil, err
+		}
+		ref = &spoolRef{seg: seg, n: 1}
+	}
+
+	// already buffering or failed request. A single large write may be
+	// split (by bufferList.add) across more than one outgoing batch, so
+	// wait on all of them; the caller gets back the response of the last
+	// one to complete.
+	batches, err := r.list.add(buf, path, query, auth, ref)
 	if err != nil {
+		if ref != nil {
+			// the record is already durably on disk but no batch holds its
+			// spoolRef, so ack it now or the segment holding it can never
+			// be freed.
+			r.spool.ack(ref.seg, ref.n)
+		}
 		return nil, err
 	}
+	if len(batches) == 0 && ref != nil {
+		// buf had nothing in it to queue (e.g. an empty write body); the
+		// spool record it produced will never be attached to a batch, so
+		// ack it now instead of leaking the segment that holds it.
+		r.spool.ack(ref.seg, ref.n)
+	}
 
-	batch.wg.Wait()
-	return batch.resp, nil
+	var resp *responseData
+	for _, b := range batches {
+		b.wg.Wait()
+		if b.resp != nil {
+			resp = b.resp
+		}
+	}
+	return resp, nil
 }
 
 func (r *retryBuffer) getStats() map[string]interface{} {
-	return r.list.getStats()
+	stats := r.list.getStats()
+	if r.spool != nil {
+		bytes, segments, oldestAge := r.spool.stats()
+		stats["spool_bytes"] = bytes
+		stats["spool_segments"] = segments
+		stats["oldest_record_age"] = oldestAge.String()
+	}
+
+	stats["dropped_records"] = atomic.LoadInt64(&r.droppedRecords)
+	stats["dead_lettered_bytes"] = atomic.LoadInt64(&r.deadLetteredBytes)
+	if reason, ok := r.lastDeadLetterReason.Load().(string); ok {
+		stats["last_dead_letter_reason"] = reason
+	}
+
+	return stats
 }
 
-func (r *retryBuffer) run() {
+// worker pops ready batches and drives them to completion one at a time,
+// retrying with exponential backoff. Several workers run concurrently, but
+// bufferList.pop never hands out two batches for the same key at once, so
+// per-key ordering is preserved.
+func (r *retryBuffer) worker() {
 	buf := bytes.NewBuffer(make([]byte, 0, r.maxBatch))
 	for {
 		buf.Reset()
-		batch := r.list.pop()
-		if batch == nil {
+		popped := r.list.pop()
+		if popped == nil {
 			continue
 		}
+		batch := popped.batch
 
 		for _, b := range batch.bufs {
 			buf.Write(b)
+			if batch.path == "/write" {
+				// bufs holds individual points with their newline already
+				// stripped by splitLines; restore the separator so the
+				// posted body is valid line protocol rather than points
+				// glued together.
+				buf.WriteByte('\n')
+			}
 		}
 
+		bufferingPtr := r.bufferingFlag(popped.key)
 		interval := r.initialInterval
 		for {
 			resp, err := r.p.post(buf.Bytes(), batch.path, batch.query, batch.auth)
-			if err == nil && resp.StatusCode/100 != 5 {
+			decision := classify(resp, err)
+
+			if decision.success {
 				// log.Printf("Detect influxdb recovery")
 				batch.resp = resp
-				atomic.StoreInt32(&r.buffering, 0)
+				atomic.StoreInt32(bufferingPtr, 0)
+				r.ackSpool(batch)
+				batch.wg.Done()
+				break
+			}
+
+			if batch.path == "/write" && resp != nil && resp.StatusCode == 400 && isPartialWrite(resp.Body) {
+				if r.trimPartialWrite(batch, resp, decision.reason) {
+					if len(batch.bufs) == 0 {
+						// every point in the batch was rejected
+						batch.resp = resp
+						atomic.StoreInt32(bufferingPtr, 0)
+						r.ackSpool(batch)
+						batch.wg.Done()
+						break
+					}
+					buf.Reset()
+					for _, b := range batch.bufs {
+						buf.Write(b)
+						buf.WriteByte('\n')
+					}
+					// retry immediately with the trimmed batch, no backoff
+					continue
+				}
+			}
+
+			batch.attempts++
+			exhausted := r.maxAttempts > 0 && batch.attempts >= r.maxAttempts
+			if !decision.retry || exhausted {
+				r.dropToDeadLetter(batch, resp, decision.reason)
+				batch.resp = resp
+				atomic.StoreInt32(bufferingPtr, 0)
 				batch.wg.Done()
 				break
 			}
@@ -102,10 +327,89 @@ func (r *retryBuffer) run() {
 					interval = r.maxInterval
 				}
 			}
+			r.list.setInterval(popped.key, interval)
 
 			time.Sleep(interval)
 		}
+
+		r.list.release(popped.key)
+	}
+}
+
+// ackSpool tells the spool (if any) that every record making up batch was
+// successfully delivered, so the segments holding them can be freed.
+func (r *retryBuffer) ackSpool(batch *batch) {
+	if r.spool == nil {
+		return
+	}
+	for _, ref := range batch.spoolRefs {
+		r.spool.ack(ref.seg, ref.n)
+	}
+}
+
+// trimPartialWrite handles InfluxDB's HTTP 400 "partial write" response: it
+// parses out the specific point(s) InfluxDB rejected, dead-letters just
+// those, and removes them from batch so the remainder can be resubmitted.
+// It returns false if resp.Body didn't name any offending point that
+// actually matched a line in this batch — e.g. InfluxDB's error text
+// truncated or re-escaped the line — in which case no progress was made and
+// the caller must fall back to the ordinary exhausted/dead-letter path
+// instead of retrying the same batch forever with no backoff.
+func (r *retryBuffer) trimPartialWrite(batch *batch, resp *responseData, reason string) bool {
+	bad := partialWriteBadLines(resp.Body)
+	if len(bad) == 0 {
+		return false
+	}
+
+	badSet := make(map[string]bool, len(bad))
+	for _, line := range bad {
+		badSet[string(line)] = true
+	}
+
+	kept := make([][]byte, 0, len(batch.bufs))
+	keptSize := 0
+	for _, line := range batch.bufs {
+		if badSet[string(line)] {
+			// log.Printf("dropping rejected point for %s: %s", batch.path, reason)
+			r.dropToDeadLetter(newBatch(line, batch.path, batch.query, batch.auth, nil), resp, reason)
+			continue
+		}
+		kept = append(kept, line)
+		keptSize += len(line)
+	}
+
+	if len(kept) == len(batch.bufs) {
+		// none of the reported bad lines matched anything in this batch;
+		// nothing was actually dropped, so treat this as unhandled.
+		return false
 	}
+
+	batch.bufs = kept
+	batch.size = keptSize
+	batch.count = len(kept)
+	return true
+}
+
+// dropToDeadLetter gives up on batch: it is no longer retried, its bytes go
+// to the configured DeadLetterSink (if any), and it is acked out of the
+// spool since it will never be reposted. batch.count records are added to
+// droppedRecords, whether batch is a whole exhausted/non-retriable batch or
+// a single point trimPartialWrite peeled off to drop on its own.
+func (r *retryBuffer) dropToDeadLetter(batch *batch, resp *responseData, reason string) {
+	atomic.AddInt64(&r.droppedRecords, int64(batch.count))
+	atomic.AddInt64(&r.deadLetteredBytes, int64(batch.size))
+	r.lastDeadLetterReason.Store(reason)
+
+	if r.deadLetter != nil {
+		statusCode := 0
+		if resp != nil {
+			statusCode = resp.StatusCode
+		}
+		// log.Printf("dead-lettering batch for %s: %s", batch.path, reason)
+		r.deadLetter.Write(batch, statusCode, reason)
+	}
+
+	r.ackSpool(batch)
 }
 
 type batch struct {
@@ -117,13 +421,22 @@ type batch struct {
 	count int
 	full  bool
 
+	// attempts counts how many times this batch has been posted and
+	// classified as a failure, retriable or not; it is compared against
+	// retryBuffer.maxAttempts to decide when to give up and dead-letter it.
+	attempts int
+
+	// spoolRefs records which on-disk spool segments the bytes in this
+	// batch came from, so they can be acked once the batch is delivered.
+	spoolRefs []spoolRef
+
 	wg   sync.WaitGroup
 	resp *responseData
 
 	next *batch
 }
 
-func newBatch(buf []byte, path string, query string, auth string) *batch {
+func newBatch(buf []byte, path string, query string, auth string, ref *spoolRef) *batch {
 	b := new(batch)
 	b.bufs = [][]byte{buf}
 	b.size = len(buf)
@@ -131,100 +444,328 @@ func newBatch(buf []byte, path string, query string, auth string) *batch {
 	b.query = query
 	b.path = path
 	b.auth = auth
+	if ref != nil {
+		b.spoolRefs = append(b.spoolRefs, *ref)
+	}
 	b.wg.Add(1)
 	return b
 }
 
+// keyQueue is the FIFO of pending batches for a single bufferKey, plus the
+// in-flight/backoff state needed to serialize delivery to that destination
+// while letting other keys proceed in parallel.
+type keyQueue struct {
+	head *batch
+
+	inFlight bool
+	interval time.Duration
+}
+
+// poppedBatch is returned by bufferList.pop: the batch to deliver, and the
+// key it must be released under once delivery finishes (or is abandoned).
+type poppedBatch struct {
+	batch *batch
+	key   bufferKey
+}
+
 type bufferList struct {
-	cond     *sync.Cond
-	head     *batch
-	size     int
-	count    int
-	maxSize  int
-	maxBatch int
+	cond      *sync.Cond
+	queues    map[bufferKey]*keyQueue
+	size      int
+	count     int
+	maxSize   int
+	maxBatch  int
+	maxPoints int
 }
 
-func newBufferList(maxSize, maxBatch int) *bufferList {
+func newBufferList(maxSize, maxBatch, maxPoints int) *bufferList {
 	return &bufferList{
-		cond:     sync.NewCond(new(sync.Mutex)),
-		maxSize:  maxSize,
-		maxBatch: maxBatch,
+		cond:      sync.NewCond(new(sync.Mutex)),
+		queues:    make(map[bufferKey]*keyQueue),
+		maxSize:   maxSize,
+		maxBatch:  maxBatch,
+		maxPoints: maxPoints,
+	}
+}
+
+// fits reports whether one more point of size n, bringing b's count to
+// count+1, still fits within this list's per-batch byte and point limits.
+func (l *bufferList) fits(b *batch, n int) bool {
+	if b.size+n > l.maxBatch {
+		return false
+	}
+	if l.maxPoints > 0 && b.count >= l.maxPoints {
+		return false
 	}
+	return true
 }
 
-// pop will remove and return the first element of the list, blocking if necessary
-func (l *bufferList) pop() *batch {
+// pop removes and returns the head batch of any key that currently has a
+// batch waiting and is not already in flight, blocking until one is
+// available. The key is marked in-flight until the caller calls release.
+func (l *bufferList) pop() *poppedBatch {
 	l.cond.L.Lock()
 	defer l.cond.L.Unlock()
 
-	for l.count == 0 {
+	for {
+		for key, q := range l.queues {
+			if q.head == nil || q.inFlight {
+				continue
+			}
+
+			b := q.head
+			q.head = b.next
+			q.inFlight = true
+			l.size -= b.size
+			l.count -= b.count
+
+			return &poppedBatch{batch: b, key: key}
+		}
+
 		l.cond.Wait()
 	}
+}
 
-	b := l.head
+// release marks key no longer in flight, allowing a worker to pop its next
+// batch (if any) or another worker to pop it in parallel with a different
+// key. Empty, idle queues are dropped so the map doesn't grow without bound.
+func (l *bufferList) release(key bufferKey) {
+	l.cond.L.Lock()
+	defer l.cond.L.Unlock()
 
-	// log.Printf("pop %d->%d, %d->%d\n", l.size, l.size-b.size, l.count, l.count-b.count)
-	l.head = l.head.next
-	l.size -= b.size
-	l.count -= b.count
+	q := l.queues[key]
+	if q == nil {
+		return
+	}
+	q.inFlight = false
+	q.interval = 0
+	if q.head == nil {
+		delete(l.queues, key)
+	}
+	l.cond.Broadcast()
+}
 
-	return b
+// setInterval records the current retry backoff for key so it can be
+// reported by getStats while a worker is mid-retry.
+func (l *bufferList) setInterval(key bufferKey, interval time.Duration) {
+	l.cond.L.Lock()
+	defer l.cond.L.Unlock()
+
+	if q := l.queues[key]; q != nil {
+		q.interval = interval
+	}
 }
 
-func (l *bufferList) add(buf []byte, path, query string, auth string) (*batch, error) {
+func (l *bufferList) queueFor(key bufferKey) *keyQueue {
+	q := l.queues[key]
+	if q == nil {
+		q = &keyQueue{}
+		l.queues[key] = q
+	}
+	return q
+}
+
+// add queues buf for delivery and returns every batch it ended up
+// contributing to (almost always one, but a write large enough to spill
+// past maxBatch/maxPoints is split across several). For path == "/write",
+// buf is parsed into individual points, normalized to nanosecond timestamps,
+// and merged with whatever is already queued for the same destination
+// (db/rp/auth) regardless of precision; other paths are queued as a single
+// opaque chunk, as before.
+func (l *bufferList) add(buf []byte, path, query string, auth string, ref *spoolRef) ([]*batch, error) {
 	l.cond.L.Lock()
 	defer l.cond.L.Unlock()
 
-	if l.size+len(buf) > l.maxSize {
+	if path != "/write" {
+		if l.size+len(buf) > l.maxSize {
+			return nil, ErrBufferFull
+		}
+		l.size += len(buf)
+		l.count++
+
+		// non-write requests are never coalesced: each becomes its own
+		// batch, since their bodies are opaque (not line-protocol points)
+		// and concatenating two of them would produce an invalid request.
+		q := l.queueFor(bufferKey{path, query, auth})
+		if tail := lastBatch(&q.head); tail != nil {
+			tail.full = true
+		}
+		tail := newBatch(buf, path, query, auth, ref)
+		*appendPtr(&q.head) = tail
+
+		l.cond.Signal()
+		return []*batch{tail}, nil
+	}
+
+	destQuery, precision := writeKey(query)
+	points := splitLines(buf)
+
+	total := 0
+	normalized := make([][]byte, len(points))
+	for i, p := range points {
+		normalized[i] = normalizeLinePrecision(p, precision)
+		total += len(normalized[i])
+	}
+
+	if l.size+total > l.maxSize {
 		return nil, ErrBufferFull
 	}
+	l.size += total
+	l.count += len(normalized)
+
+	q := l.queueFor(bufferKey{path, destQuery, auth})
+	touched := l.appendPoints(q, path, destQuery, auth, normalized)
+
+	// The spool holds buf as a single record; it can only be acked once
+	// every point split out of it has been resolved, which happens when
+	// the last batch it landed in finishes (earlier batches may finish
+	// sooner, but the segment they came from is only freed once this one
+	// does too).
+	if ref != nil && len(touched) > 0 {
+		last := touched[len(touched)-1]
+		last.spoolRefs = append(last.spoolRefs, *ref)
+	}
 
-	// log.Printf("add %d->%d, %d->%d\n", l.size, l.size+len(buf), l.count, l.count+1)
-	l.size += len(buf)
-	l.count++
 	l.cond.Signal()
+	return touched, nil
+}
 
-	var cur **batch
+// appendPoints appends each of points to q, starting a new batch whenever
+// the current tail is full or does not have room (by bytes or maxPoints) for
+// the next point. It returns every distinct batch the points landed in, in
+// order.
+func (l *bufferList) appendPoints(q *keyQueue, path, query, auth string, points [][]byte) []*batch {
+	cur := appendPtr(&q.head)
+	tail := lastBatch(&q.head)
+
+	var touched []*batch
+	for _, p := range points {
+		if tail == nil || tail.full || !l.fits(tail, len(p)) {
+			if tail != nil {
+				tail.full = true
+			}
+			tail = newBatch(p, path, query, auth, nil)
+			*cur = tail
+			cur = &tail.next
+		} else {
+			tail.size += len(p)
+			tail.count++
+			tail.bufs = append(tail.bufs, p)
+		}
 
-	// non-nil batches that either don't match the query string, don't match the auth
-	// credentials, or would be too large when adding the current set of points
-	// (auth must be checked to prevent potential problems in multi-user scenarios)
-	for cur = &l.head; *cur != nil; cur = &(*cur).next {
-		if path != "/write" {
-			continue
+		if len(touched) == 0 || touched[len(touched)-1] != tail {
+			touched = append(touched, tail)
 		}
+	}
+	return touched
+}
 
-		if (*cur).path != path || (*cur).query != query || (*cur).auth != auth || (*cur).full {
-			continue
+// lastBatch returns the final batch in the chain starting at *head, or nil
+// if the chain is empty.
+func lastBatch(head **batch) *batch {
+	b := *head
+	for b != nil && b.next != nil {
+		b = b.next
+	}
+	return b
+}
+
+// appendPtr returns the address of the `next` field (or head itself) where
+// a new tail batch should be linked in.
+func appendPtr(head **batch) **batch {
+	cur := head
+	for *cur != nil {
+		cur = &(*cur).next
+	}
+	return cur
+}
+
+// addSpooled seeds the buffer with records recovered from the on-disk spool
+// at startup, preserving their original per-key order. It bypasses the
+// maxSize check performed by add, since these bytes were already accepted
+// (and spooled) by a previous run of the relay.
+func (l *bufferList) addSpooled(records []spoolRecord, refs []spoolRef) {
+	l.cond.L.Lock()
+	defer l.cond.L.Unlock()
+
+	// refs is one entry per segment; expand it back into one ref per record
+	// so each replayed batch can be acked precisely once it is delivered.
+	expanded := make([]spoolRef, 0, len(records))
+	for _, ref := range refs {
+		for i := 0; i < ref.n; i++ {
+			expanded = append(expanded, spoolRef{seg: ref.seg, n: 1})
 		}
+	}
 
-		if (*cur).size+len(buf) > l.maxBatch {
-			// prevent future writes from preceding this write
-			(*cur).full = true
+	for i, rec := range records {
+		if rec.path != "/write" {
+			l.size += len(rec.buf)
+			l.count++
+
+			// non-write requests are never coalesced; see the matching
+			// comment in add().
+			key := bufferKey{rec.path, rec.query, rec.auth}
+			q := l.queueFor(key)
+			if tail := lastBatch(&q.head); tail != nil {
+				tail.full = true
+			}
+			nb := newBatch(rec.buf, rec.path, rec.query, rec.auth, &expanded[i])
+			*appendPtr(&q.head) = nb
 			continue
 		}
 
-		break
-	}
-
-	if *cur == nil {
-		// new tail element
-		*cur = newBatch(buf, path, query, auth)
-	} else {
-		// append to current batch
-		b := *cur
-		b.size += len(buf)
-		b.count++
-		b.bufs = append(b.bufs, buf)
+		destQuery, precision := writeKey(rec.query)
+		points := splitLines(rec.buf)
+		normalized := make([][]byte, len(points))
+		total := 0
+		for j, p := range points {
+			normalized[j] = normalizeLinePrecision(p, precision)
+			total += len(normalized[j])
+		}
+		l.size += total
+		l.count += len(normalized)
+
+		key := bufferKey{rec.path, destQuery, rec.auth}
+		q := l.queueFor(key)
+		touched := l.appendPoints(q, rec.path, destQuery, rec.auth, normalized)
+		if len(touched) > 0 {
+			last := touched[len(touched)-1]
+			last.spoolRefs = append(last.spoolRefs, expanded[i])
+		}
 	}
 
-	return *cur, nil
+	l.cond.Broadcast()
 }
 
 func (l *bufferList) getStats() map[string]interface{} {
+	l.cond.L.Lock()
+	defer l.cond.L.Unlock()
+
+	perKey := make(map[string]interface{}, len(l.queues))
+	for key, q := range l.queues {
+		inFlight := 0
+		if q.inFlight {
+			inFlight = 1
+		}
+		perKey[key.path+"|"+key.query+"|"+key.auth] = map[string]interface{}{
+			"in_flight":   inFlight,
+			"backoff_ms":  q.interval.Milliseconds(),
+			"queue_depth": batchChainLen(q.head),
+		}
+	}
+
 	return map[string]interface{}{
 		"buffered_bytes": l.size,
 		"buffered_count": l.count,
 		"buffer_size":    l.maxSize,
+		"per_key":        perKey,
+	}
+}
+
+func batchChainLen(b *batch) int {
+	n := 0
+	for ; b != nil; b = b.next {
+		n++
 	}
+	return n
 }
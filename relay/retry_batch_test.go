@@ -0,0 +1,66 @@
+package relay
+
+import (
+	"bytes"
+	"testing"
+)
+
+// TestBufferListWriteBatchProducesValidLineProtocol checks that a /write
+// batch holds its points as separate, newline-free bufs, so that joining
+// them with '\n' (the way worker() builds its POST body, reproduced here)
+// gives back valid line protocol with the original points.
+func TestBufferListWriteBatchProducesValidLineProtocol(t *testing.T) {
+	l := newBufferList(1<<20, 1<<20, 0)
+
+	if _, err := l.add([]byte("m1,t=1 f=1 100\nm2,t=2 f=2 200\n"), "/write", "db=a", "", nil); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+
+	popped := l.pop()
+	if len(popped.batch.bufs) != 2 {
+		t.Fatalf("batch has %d points, want 2", len(popped.batch.bufs))
+	}
+
+	var buf bytes.Buffer
+	for _, b := range popped.batch.bufs {
+		buf.Write(b)
+		buf.WriteByte('\n')
+	}
+
+	points := splitLines(buf.Bytes())
+	want := []string{"m1,t=1 f=1 100", "m2,t=2 f=2 200"}
+	if len(points) != len(want) {
+		t.Fatalf("rebuilt body has %d points, want %d: %q", len(points), len(want), buf.String())
+	}
+	for i, p := range points {
+		if string(p) != want[i] {
+			t.Errorf("point %d = %q, want %q", i, p, want[i])
+		}
+	}
+}
+
+// TestBufferListNonWriteBatchesNeverCoalesce guards against the regression
+// where two non-"/write" requests sharing a (path, query, auth) key got
+// merged into one batch and their opaque bodies concatenated with no
+// separator, corrupting the request body.
+func TestBufferListNonWriteBatchesNeverCoalesce(t *testing.T) {
+	l := newBufferList(1<<20, 1<<20, 0)
+
+	if _, err := l.add([]byte("first"), "/query", "q=x", "", nil); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	if _, err := l.add([]byte("second"), "/query", "q=x", "", nil); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+
+	first := l.pop()
+	if len(first.batch.bufs) != 1 || string(first.batch.bufs[0]) != "first" {
+		t.Fatalf("first popped batch = %+v, want a single-buf batch holding \"first\"", first.batch)
+	}
+	l.release(first.key)
+
+	second := l.pop()
+	if len(second.batch.bufs) != 1 || string(second.batch.bufs[0]) != "second" {
+		t.Fatalf("second popped batch = %+v, want a single-buf batch holding \"second\"", second.batch)
+	}
+}
@@ -0,0 +1,390 @@
+package relay
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultSpoolSegmentBytes is used when newSpool is given a segmentBytes of
+// 0, i.e. the caller doesn't care to tune rotation size.
+const defaultSpoolSegmentBytes = 32 * 1024 * 1024
+
+// spoolSyncEvery bounds how many records may be appended between fsyncs.
+// Fsyncing every single record serializes all writers behind one disk flush
+// and the spool's mutex; batching them trades a small window of possible
+// data loss on crash (at most spoolSyncEvery-1 unsynced records) for much
+// better throughput, the same tradeoff etcd's backend makes for its own WAL.
+const spoolSyncEvery = 64
+
+const spoolFileSuffix = ".wal"
+
+// spoolRecord is a single buffered write as it is framed on disk.
+type spoolRecord struct {
+	path  string
+	query string
+	auth  string
+	buf   []byte
+}
+
+// spoolSegment is one append-only WAL file making up part of the spool.
+// pending tracks how many records in the segment have not yet been
+// successfully POSTed; the segment's file is removed once pending reaches 0
+// and the segment is no longer the active one.
+type spoolSegment struct {
+	id      uint64
+	path    string
+	f       *os.File
+	size    int64
+	pending int
+	oldest  time.Time
+}
+
+// spoolRef records which segment(s) a batch's bytes were appended to, so the
+// spool can be told which records were actually delivered once worker() gets
+// a successful response.
+type spoolRef struct {
+	seg *spoolSegment
+	n   int
+}
+
+// spool is a segmented, append-only, on-disk write-ahead log backing a
+// retryBuffer. It lets buffered writes survive a relay restart or crash:
+// every write that retryBuffer.post buffers (rather than delivering it
+// directly) is appended here before it is handed to the in-memory
+// bufferList, and a segment is only deleted once
+// every record it holds has been acknowledged as delivered.
+type spool struct {
+	mu sync.Mutex
+
+	dir          string
+	maxBytes     int64
+	segmentBytes int64
+
+	segments []*spoolSegment // oldest first
+	cur      *spoolSegment
+	nextID   uint64
+
+	size     int64 // total bytes across all segments
+	unsynced int    // records appended since the last fsync
+}
+
+// newSpool opens (or creates) a WAL spool under dir. segmentBytes is the
+// size at which the active segment is rotated to a new file; 0 selects
+// defaultSpoolSegmentBytes.
+func newSpool(dir string, maxBytes, segmentBytes int64) (*spool, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	if segmentBytes <= 0 {
+		segmentBytes = defaultSpoolSegmentBytes
+	}
+	s := &spool{dir: dir, maxBytes: maxBytes, segmentBytes: segmentBytes}
+	if err := s.openExisting(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *spool) openExisting() error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+
+	var ids []uint64
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), spoolFileSuffix) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(e.Name(), spoolFileSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	for _, id := range ids {
+		p := s.segmentPath(id)
+		fi, err := os.Stat(p)
+		if err != nil {
+			return err
+		}
+		seg := &spoolSegment{id: id, path: p, size: fi.Size(), oldest: fi.ModTime()}
+		s.segments = append(s.segments, seg)
+		s.size += seg.size
+		if id >= s.nextID {
+			s.nextID = id + 1
+		}
+	}
+	return nil
+}
+
+func (s *spool) segmentPath(id uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%010d%s", id, spoolFileSuffix))
+}
+
+// replay scans every segment on disk and returns the records they contain in
+// the order they were originally written, along with the spoolRef each
+// record should be acknowledged against once it is successfully reposted.
+// A corrupt (partially written) record is treated as the end of a crash-torn
+// segment: everything up to it is replayed and the rest of that segment is
+// discarded.
+func (s *spool) replay() ([]spoolRecord, []spoolRef, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var records []spoolRecord
+	var refs []spoolRef
+
+	for _, seg := range s.segments {
+		f, err := os.OpenFile(seg.path, os.O_RDWR, 0o644)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		var validSize int64
+		n := 0
+		for {
+			rec, recLen, err := readSpoolRecord(f)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				// CRC mismatch or truncated write: stop replaying this
+				// segment here, it is the crash-torn tail.
+				break
+			}
+			records = append(records, rec)
+			validSize += recLen
+			n++
+		}
+
+		if validSize != seg.size {
+			// Drop the torn tail so future appends don't land after a
+			// half-written record.
+			if err := f.Truncate(validSize); err != nil {
+				f.Close()
+				return nil, nil, err
+			}
+			s.size -= seg.size - validSize
+			seg.size = validSize
+		}
+		if _, err := f.Seek(0, io.SeekEnd); err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+
+		seg.f = f
+		seg.pending = n
+		if n > 0 {
+			refs = append(refs, spoolRef{seg: seg, n: n})
+		}
+		s.cur = seg
+	}
+
+	// Drop now-empty segments (e.g. an existing but entirely torn segment).
+	kept := s.segments[:0]
+	for _, seg := range s.segments {
+		if seg.size == 0 && seg != s.cur {
+			seg.f.Close()
+			os.Remove(seg.path)
+			continue
+		}
+		kept = append(kept, seg)
+	}
+	s.segments = kept
+
+	return records, refs, nil
+}
+
+// append writes one record to the active segment, rotating to a new segment
+// first if needed. It fsyncs at most once every spoolSyncEvery records
+// rather than after each one, so a burst of appends shares a single disk
+// flush instead of serializing behind one fsync apiece; a rotation always
+// flushes the segment being retired so a completed segment is never left
+// partially synced. It returns the segment the record landed in so the
+// caller can later ack it.
+func (s *spool) append(path, query, auth string, buf []byte) (*spoolSegment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	recLen := spoolRecordLen(path, query, auth, buf)
+
+	if s.maxBytes > 0 && s.size+recLen > s.maxBytes {
+		return nil, ErrBufferFull
+	}
+
+	if s.cur == nil || s.cur.size+recLen > s.segmentBytes {
+		if err := s.rotate(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := writeSpoolRecord(s.cur.f, path, query, auth, buf); err != nil {
+		return nil, err
+	}
+
+	s.unsynced++
+	if s.unsynced >= spoolSyncEvery {
+		if err := s.cur.f.Sync(); err != nil {
+			return nil, err
+		}
+		s.unsynced = 0
+	}
+
+	s.cur.size += recLen
+	s.cur.pending++
+	if s.cur.pending == 1 {
+		s.cur.oldest = time.Now()
+	}
+	s.size += recLen
+
+	return s.cur, nil
+}
+
+func (s *spool) rotate() error {
+	if s.cur != nil && s.unsynced > 0 {
+		if err := s.cur.f.Sync(); err != nil {
+			return err
+		}
+		s.unsynced = 0
+	}
+
+	id := s.nextID
+	s.nextID++
+	p := s.segmentPath(id)
+	f, err := os.OpenFile(p, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	old := s.cur
+	seg := &spoolSegment{id: id, path: p, f: f}
+	s.segments = append(s.segments, seg)
+	s.cur = seg
+
+	// every record of the retired segment was acked while it was still
+	// active, when ack could not remove it; remove it now.
+	if old != nil && old.pending <= 0 {
+		old.f.Close()
+		os.Remove(old.path)
+		s.size -= old.size
+		for i, sg := range s.segments {
+			if sg == old {
+				s.segments = append(s.segments[:i], s.segments[i+1:]...)
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// ack marks n records in seg as durably delivered. Once every record in a
+// non-active segment has been acked, its file is removed from disk.
+func (s *spool) ack(seg *spoolSegment, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seg.pending -= n
+	if seg.pending > 0 || seg == s.cur {
+		return
+	}
+
+	seg.f.Close()
+	os.Remove(seg.path)
+	s.size -= seg.size
+
+	for i, sg := range s.segments {
+		if sg == seg {
+			s.segments = append(s.segments[:i], s.segments[i+1:]...)
+			break
+		}
+	}
+}
+
+func (s *spool) stats() (bytes int64, segments int, oldestAge time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.segments) == 0 {
+		return 0, 0, 0
+	}
+	return s.size, len(s.segments), time.Since(s.segments[0].oldest)
+}
+
+// Record framing: crc32(4) | totalLen(4) | pathLen(2) path | queryLen(2) query | authLen(2) auth | bufLen(4) buf
+
+func spoolRecordLen(path, query, auth string, buf []byte) int64 {
+	return int64(4 + 4 + 2 + len(path) + 2 + len(query) + 2 + len(auth) + 4 + len(buf))
+}
+
+func writeSpoolRecord(w io.Writer, path, query, auth string, buf []byte) error {
+	body := make([]byte, 0, spoolRecordLen(path, query, auth, buf)-8)
+	body = appendUint16String(body, path)
+	body = appendUint16String(body, query)
+	body = appendUint16String(body, auth)
+	body = binary.BigEndian.AppendUint32(body, uint32(len(buf)))
+	body = append(body, buf...)
+
+	crc := crc32.ChecksumIEEE(body)
+
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint32(header[0:4], crc)
+	binary.BigEndian.PutUint32(header[4:8], uint32(len(body)))
+
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(body)
+	return err
+}
+
+func readSpoolRecord(r io.Reader) (spoolRecord, int64, error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return spoolRecord{}, 0, err
+	}
+	crc := binary.BigEndian.Uint32(header[0:4])
+	bodyLen := binary.BigEndian.Uint32(header[4:8])
+
+	body := make([]byte, bodyLen)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return spoolRecord{}, 0, io.ErrUnexpectedEOF
+	}
+
+	if crc32.ChecksumIEEE(body) != crc {
+		return spoolRecord{}, 0, fmt.Errorf("relay: spool record CRC mismatch")
+	}
+
+	off := 0
+	path, off := readUint16String(body, off)
+	query, off := readUint16String(body, off)
+	auth, off := readUint16String(body, off)
+	bufLen := binary.BigEndian.Uint32(body[off : off+4])
+	off += 4
+	buf := make([]byte, bufLen)
+	copy(buf, body[off:off+int(bufLen)])
+
+	return spoolRecord{path: path, query: query, auth: auth, buf: buf}, int64(8 + len(body)), nil
+}
+
+func appendUint16String(dst []byte, s string) []byte {
+	dst = binary.BigEndian.AppendUint16(dst, uint16(len(s)))
+	return append(dst, s...)
+}
+
+func readUint16String(src []byte, off int) (string, int) {
+	n := int(binary.BigEndian.Uint16(src[off : off+2]))
+	off += 2
+	s := string(src[off : off+n])
+	return s, off + n
+}
@@ -0,0 +1,151 @@
+package relay
+
+import (
+	"os"
+	"testing"
+)
+
+func TestSpoolAppendAndReplay(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := newSpool(dir, 0, 0)
+	if err != nil {
+		t.Fatalf("newSpool: %v", err)
+	}
+
+	want := []spoolRecord{
+		{path: "/write", query: "db=a", auth: "", buf: []byte("m,t=1 f=1 100\n")},
+		{path: "/write", query: "db=a", auth: "", buf: []byte("m,t=2 f=2 200\n")},
+		{path: "/query", query: "db=a", auth: "auth", buf: []byte("q=SELECT")},
+	}
+	for _, rec := range want {
+		if _, err := s.append(rec.path, rec.query, rec.auth, rec.buf); err != nil {
+			t.Fatalf("append: %v", err)
+		}
+	}
+
+	// Simulate a relay restart: reopen the spool from disk and replay it.
+	reopened, err := newSpool(dir, 0, 0)
+	if err != nil {
+		t.Fatalf("reopen newSpool: %v", err)
+	}
+	got, refs, err := reopened.replay()
+	if err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("replay returned %d records, want %d", len(got), len(want))
+	}
+	for i, rec := range got {
+		if rec.path != want[i].path || rec.query != want[i].query || rec.auth != want[i].auth || string(rec.buf) != string(want[i].buf) {
+			t.Errorf("record %d = %+v, want %+v", i, rec, want[i])
+		}
+	}
+	if len(refs) != 1 || refs[0].n != len(want) {
+		t.Errorf("refs = %+v, want a single ref covering all %d records", refs, len(want))
+	}
+}
+
+// TestSpoolReplayDropsTornTail simulates a crash mid-append: the last record
+// written is truncated partway through its 8-byte header, as if the process
+// died after only its CRC made it to disk.
+// replay must discard the torn record and still return everything before it.
+func TestSpoolReplayDropsTornTail(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := newSpool(dir, 0, 0)
+	if err != nil {
+		t.Fatalf("newSpool: %v", err)
+	}
+	seg, err := s.append("/write", "db=a", "", []byte("m,t=1 f=1 100\n"))
+	if err != nil {
+		t.Fatalf("append: %v", err)
+	}
+	fullSize := seg.size
+	if _, err := s.append("/write", "db=a", "", []byte("m,t=2 f=2 200\n")); err != nil {
+		t.Fatalf("append: %v", err)
+	}
+
+	// Truncate the file back into the middle of the second record, as a
+	// torn write would leave it.
+	if err := os.Truncate(seg.path, fullSize+4); err != nil {
+		t.Fatalf("truncate: %v", err)
+	}
+
+	reopened, err := newSpool(dir, 0, 0)
+	if err != nil {
+		t.Fatalf("reopen newSpool: %v", err)
+	}
+	got, _, err := reopened.replay()
+	if err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("replay returned %d records, want 1 (torn record dropped)", len(got))
+	}
+	if string(got[0].buf) != "m,t=1 f=1 100\n" {
+		t.Errorf("replay kept record %q, want the untorn first record", got[0].buf)
+	}
+
+	fi, err := os.Stat(seg.path)
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	if fi.Size() != fullSize {
+		t.Errorf("segment file left at %d bytes, want truncated back to %d", fi.Size(), fullSize)
+	}
+}
+
+func TestSpoolSegmentRotation(t *testing.T) {
+	dir := t.TempDir()
+
+	const segmentBytes = 64
+	s, err := newSpool(dir, 0, segmentBytes)
+	if err != nil {
+		t.Fatalf("newSpool: %v", err)
+	}
+
+	buf := []byte("m,t=1 f=1 100\n")
+	for i := 0; i < 10; i++ {
+		if _, err := s.append("/write", "db=a", "", buf); err != nil {
+			t.Fatalf("append %d: %v", i, err)
+		}
+	}
+
+	if len(s.segments) < 2 {
+		t.Fatalf("got %d segments, want rotation to have produced more than one at segmentBytes=%d", len(s.segments), segmentBytes)
+	}
+	for _, seg := range s.segments {
+		if seg != s.cur && seg.size > segmentBytes+spoolRecordLen("/write", "db=a", "", buf) {
+			t.Errorf("retired segment %d holds %d bytes, want roughly <= %d", seg.id, seg.size, segmentBytes)
+		}
+	}
+}
+
+func TestSpoolAckFreesSegment(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := newSpool(dir, 0, 64)
+	if err != nil {
+		t.Fatalf("newSpool: %v", err)
+	}
+
+	buf := []byte("m,t=1 f=1 100\n")
+	seg, err := s.append("/write", "db=a", "", buf)
+	if err != nil {
+		t.Fatalf("append: %v", err)
+	}
+	// Force a rotation so seg is no longer the active segment.
+	if _, err := s.append("/write", "db=a", "", make([]byte, 128)); err != nil {
+		t.Fatalf("append: %v", err)
+	}
+	if seg == s.cur {
+		t.Fatal("test setup: expected rotation to a new segment")
+	}
+
+	s.ack(seg, 1)
+
+	if _, err := os.Stat(seg.path); !os.IsNotExist(err) {
+		t.Errorf("segment file %s still exists after its only record was acked", seg.path)
+	}
+}